@@ -0,0 +1,327 @@
+// Package handlers handles the routes
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+// TaskState represents the lifecycle state of a task tracked by a Broker.
+type TaskState string
+
+// States a TaskMessage can be in while it moves through a Broker.
+const (
+	StateQueued    TaskState = "queued"
+	StateRunning   TaskState = "running"
+	StatePaused    TaskState = "paused"
+	StateCompleted TaskState = "completed"
+	StateFailed    TaskState = "failed"
+	StateKilled    TaskState = "killed"
+	// StateDead marks a task that exhausted MaxRetries and was moved to the
+	// dead-letter list.
+	StateDead TaskState = "dead"
+)
+
+// ErrNotFound is returned by a Broker when no task exists for a given UUID.
+var ErrNotFound = errors.New("handlers: task not found")
+
+// TaskMessage is the durable record a Broker stores for a single task.
+type TaskMessage struct {
+	UUID           string          `json:"uuid"`
+	Type           string          `json:"type"`
+	Payload        json.RawMessage `json:"payload"`
+	Priority       Priority        `json:"priority,omitempty"`
+	Retries        int             `json:"retries"`
+	MaxRetries     int             `json:"max_retries"`
+	TimeoutSeconds int             `json:"timeout_seconds"`
+	ScheduledAt    time.Time       `json:"scheduled_at"`
+	QueuedAt       time.Time       `json:"queued_at,omitempty"`
+	StartedAt      time.Time       `json:"started_at,omitempty"`
+	// Progress is the percentage (0-100) the task's Run has reported so far.
+	Progress int `json:"progress"`
+	// Checkpoint is the last state the task's Run checkpointed through
+	// Progress.Checkpoint. If the task is re-run (e.g. after a retry), its
+	// factory receives this instead of Payload, so it can resume instead of
+	// starting over.
+	Checkpoint json.RawMessage `json:"checkpoint,omitempty"`
+	State      TaskState       `json:"state"`
+}
+
+// Broker is a durable job backend for task-manager. Tasks survive process
+// restarts and can be dequeued by workers on any instance sharing the same
+// Broker, which is what lets the worker pool scale horizontally instead of
+// spawning one goroutine per request.
+type Broker interface {
+	// Enqueue persists a new task, making it eligible for Dequeue once its
+	// ScheduledAt time has passed.
+	Enqueue(ctx context.Context, msg *TaskMessage) error
+	// Dequeue returns the next task ready to run, blocking until one is
+	// available or ctx is cancelled.
+	Dequeue(ctx context.Context) (*TaskMessage, error)
+	// Ack marks a task as completed and removes it from the active set.
+	Ack(ctx context.Context, uuid string) error
+	// Fail records a failed attempt. Implementations reschedule with backoff
+	// when msg.Retries < msg.MaxRetries, otherwise move the task to the
+	// dead-letter list.
+	Fail(ctx context.Context, msg *TaskMessage, cause error) error
+	// Schedule updates a task's ScheduledAt and requeues it for later
+	// delivery. Used for delayed tasks and retry backoff.
+	Schedule(ctx context.Context, msg *TaskMessage, at time.Time) error
+	// Get returns the current record for uuid.
+	Get(ctx context.Context, uuid string) (*TaskMessage, error)
+	// SetState updates the state of a task so that control (pause/resume/
+	// kill) survives process restarts.
+	SetState(ctx context.Context, uuid string, state TaskState) error
+	// Update persists changes made to msg, e.g. StartedAt or Progress.
+	// Implementations copy msg's fields into their own storage, so the
+	// caller is free to keep using the *TaskMessage it passed in without
+	// racing a concurrent reader of the stored record.
+	Update(ctx context.Context, msg *TaskMessage) error
+	// DeadLetter returns tasks that exhausted their retries.
+	DeadLetter(ctx context.Context) ([]*TaskMessage, error)
+	// QueueDepths returns how many tasks are currently waiting to run in
+	// each priority, for GET /queue.
+	QueueDepths(ctx context.Context) (map[Priority]int, error)
+}
+
+// InMemoryBroker is a Broker backed by process memory. It is used in tests
+// and as a drop-in replacement when no Redis instance is configured. Tasks
+// that are due now live in a PriorityQueue so Dequeue serves higher
+// priorities first; tasks scheduled for later sit in delayed, sorted by
+// ScheduledAt, until they become due.
+type InMemoryBroker struct {
+	mu         sync.Mutex
+	notify     chan struct{}
+	tasks      map[string]*TaskMessage
+	ready      *PriorityQueue
+	delayed    []string // uuids not yet due, ordered by ScheduledAt
+	deadLetter []*TaskMessage
+}
+
+// NewInMemoryBroker creates an empty InMemoryBroker ready for use.
+func NewInMemoryBroker() *InMemoryBroker {
+	return &InMemoryBroker{
+		notify: make(chan struct{}, 1),
+		tasks:  make(map[string]*TaskMessage),
+		ready:  NewPriorityQueue(),
+	}
+}
+
+// Enqueue implements Broker. It stores its own copy of msg rather than
+// adopting the caller's pointer, so the caller and any worker that later
+// Dequeues this task never share a *TaskMessage across goroutines.
+func (b *InMemoryBroker) Enqueue(_ context.Context, msg *TaskMessage) error {
+	cp := *msg
+	cp.State = StateQueued
+	b.mu.Lock()
+	b.tasks[cp.UUID] = &cp
+	b.admitLocked(&cp)
+	b.mu.Unlock()
+	b.wake()
+	return nil
+}
+
+// Dequeue implements Broker. It prefers higher-priority tasks that are due,
+// falling back to a weighted round-robin across priorities (see
+// PriorityQueue.Pop) so lower-priority tasks still make progress. The
+// returned TaskMessage is a copy of the stored record: the caller owns it
+// exclusively and must go through Update/Fail/Ack to persist further
+// changes, rather than relying on mutating fields in place.
+func (b *InMemoryBroker) Dequeue(ctx context.Context) (*TaskMessage, error) {
+	for {
+		b.mu.Lock()
+		b.promoteDueLocked()
+		if msg, ok := b.ready.Pop(); ok {
+			// A task can be paused (via SetState) while it's still sitting in
+			// the ready queue, e.g. because the concurrency limiter hasn't
+			// let a worker pick it up yet. Don't clobber that back to
+			// running, or the pause is silently lost the moment a worker
+			// dequeues it.
+			if msg.State != StatePaused {
+				msg.State = StateRunning
+			}
+			cp := *msg
+			b.mu.Unlock()
+			return &cp, nil
+		}
+		b.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-b.notify:
+		case <-time.After(100 * time.Millisecond):
+			// wake periodically so scheduled (delayed) tasks become due
+			// even if nothing else triggers a notify
+		}
+	}
+}
+
+// admitLocked places msg onto the ready priority queue if it's already due,
+// or onto the delayed list otherwise. Callers must hold b.mu.
+func (b *InMemoryBroker) admitLocked(msg *TaskMessage) {
+	if !msg.ScheduledAt.After(time.Now()) {
+		// Push should never fail here: ringCapacity is generous and a full
+		// queue would mean the worker pool is badly backed up, in which
+		// case dropping the task silently would be worse than the task
+		// simply staying queued a little longer, so best effort is fine.
+		_ = b.ready.Push(msg)
+		return
+	}
+	b.delayed = append(b.delayed, msg.UUID)
+	sort.Slice(b.delayed, func(i, j int) bool {
+		return b.tasks[b.delayed[i]].ScheduledAt.Before(b.tasks[b.delayed[j]].ScheduledAt)
+	})
+}
+
+// promoteDueLocked moves any delayed task whose ScheduledAt has passed onto
+// the ready priority queue, marking it StateQueued in the process - this is
+// what makes StateFailed durably observable via Get for the length of a
+// retry's backoff, instead of Schedule immediately overwriting it back to
+// queued. Callers must hold b.mu.
+func (b *InMemoryBroker) promoteDueLocked() {
+	now := time.Now()
+	i := 0
+	for ; i < len(b.delayed); i++ {
+		msg := b.tasks[b.delayed[i]]
+		if msg == nil || msg.ScheduledAt.After(now) {
+			break
+		}
+		msg.State = StateQueued
+		_ = b.ready.Push(msg)
+	}
+	b.delayed = b.delayed[i:]
+}
+
+// Ack implements Broker.
+func (b *InMemoryBroker) Ack(_ context.Context, uuid string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	msg, ok := b.tasks[uuid]
+	if !ok {
+		return ErrNotFound
+	}
+	msg.State = StateCompleted
+	return nil
+}
+
+// Fail implements Broker. msg is the caller's own copy (e.g. from Dequeue),
+// so its Retries/State fields are mutated directly; the stored record is
+// only touched under b.mu, through the dead-letter copy below or via
+// Schedule.
+func (b *InMemoryBroker) Fail(ctx context.Context, msg *TaskMessage, _ error) error {
+	msg.Retries++
+	if msg.Retries > msg.MaxRetries {
+		cp := *msg
+		cp.State = StateDead
+		b.mu.Lock()
+		b.tasks[cp.UUID] = &cp
+		b.deadLetter = append(b.deadLetter, &cp)
+		b.mu.Unlock()
+		return nil
+	}
+	msg.State = StateFailed
+	return b.Schedule(ctx, msg, time.Now().Add(backoffWithJitter(msg.Retries)))
+}
+
+// Schedule implements Broker. Like Enqueue, it stores its own copy of msg
+// rather than adopting the caller's pointer. Unlike Enqueue, it leaves
+// msg.State as the caller set it (Fail sets StateFailed before calling
+// Schedule for a retry) instead of forcing StateQueued - promoteDueLocked
+// makes that transition once the task actually becomes due.
+func (b *InMemoryBroker) Schedule(_ context.Context, msg *TaskMessage, at time.Time) error {
+	cp := *msg
+	cp.ScheduledAt = at
+	b.mu.Lock()
+	b.tasks[cp.UUID] = &cp
+	b.admitLocked(&cp)
+	b.mu.Unlock()
+	b.wake()
+	return nil
+}
+
+// Get implements Broker. It returns a copy of the stored record so the
+// caller can read it without racing a worker that later calls Update.
+func (b *InMemoryBroker) Get(_ context.Context, uuid string) (*TaskMessage, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	msg, ok := b.tasks[uuid]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	cp := *msg
+	return &cp, nil
+}
+
+// SetState implements Broker.
+func (b *InMemoryBroker) SetState(_ context.Context, uuid string, state TaskState) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	msg, ok := b.tasks[uuid]
+	if !ok {
+		return ErrNotFound
+	}
+	msg.State = state
+	return nil
+}
+
+// Update implements Broker. It copies msg's fields into the stored record
+// under b.mu, so concurrent readers (GetTaskStatus, GetQueueStatus, another
+// worker) never observe a partially-written TaskMessage.
+func (b *InMemoryBroker) Update(_ context.Context, msg *TaskMessage) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	stored, ok := b.tasks[msg.UUID]
+	if !ok {
+		return ErrNotFound
+	}
+	*stored = *msg
+	return nil
+}
+
+// DeadLetter implements Broker.
+func (b *InMemoryBroker) DeadLetter(_ context.Context) ([]*TaskMessage, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	out := make([]*TaskMessage, len(b.deadLetter))
+	copy(out, b.deadLetter)
+	return out, nil
+}
+
+// QueueDepths implements Broker.
+func (b *InMemoryBroker) QueueDepths(_ context.Context) (map[Priority]int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.promoteDueLocked()
+	return b.ready.Depths(), nil
+}
+
+func (b *InMemoryBroker) wake() {
+	select {
+	case b.notify <- struct{}{}:
+	default:
+	}
+}
+
+// backoffWithJitter returns an exponential backoff duration for the given
+// retry attempt with up to 20% random jitter added to avoid thundering-herd
+// retries.
+func backoffWithJitter(attempt int) time.Duration {
+	base := time.Second << uint(attempt)
+	if base > time.Minute {
+		base = time.Minute
+	}
+	jitter := time.Duration(float64(base) * 0.2 * pseudoRandom())
+	return base + jitter
+}
+
+// pseudoRandom returns a value in [0, 1) derived from the current time. The
+// worker pool only uses this to spread retries, so a real PRNG with a seed
+// isn't warranted.
+func pseudoRandom() float64 {
+	return float64(time.Now().UnixNano()%1000) / 1000
+}
@@ -0,0 +1,260 @@
+// Package handlers handles the routes
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// redis key layout used by RedisBroker. "{ns}" is the configured Namespace.
+const (
+	redisPendingZSet = "%s:pending:%s" // sorted set per priority, score = ScheduledAt unix ts
+	redisTaskHash    = "%s:task:%s"    // JSON-marshalled TaskMessage, stored as a string value
+	redisDeadList    = "%s:deadletter"
+)
+
+// RedisBroker is a Broker backed by Redis, suitable for running the worker
+// pool across multiple task-manager instances. Tasks are stored as JSON
+// blobs per UUID and ordered for delivery using one sorted set per
+// priority keyed by ScheduledAt, so delayed/scheduled tasks and priority
+// ordering both fall out of the same ZRANGEBYSCORE call.
+type RedisBroker struct {
+	client    *redis.Client
+	namespace string
+	turn      int64 // atomic counter driving the same weighted round-robin as PriorityQueue
+}
+
+// NewRedisBroker creates a RedisBroker that stores all of its keys under
+// namespace, allowing multiple task-manager deployments to share a Redis
+// instance without colliding.
+func NewRedisBroker(client *redis.Client, namespace string) *RedisBroker {
+	return &RedisBroker{client: client, namespace: namespace}
+}
+
+func (b *RedisBroker) pendingKey(p Priority) string {
+	return fmt.Sprintf(redisPendingZSet, b.namespace, p)
+}
+
+func (b *RedisBroker) taskKey(uuid string) string {
+	return fmt.Sprintf(redisTaskHash, b.namespace, uuid)
+}
+
+func (b *RedisBroker) deadKey() string {
+	return fmt.Sprintf(redisDeadList, b.namespace)
+}
+
+func (b *RedisBroker) save(ctx context.Context, msg *TaskMessage) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	return b.client.Set(ctx, b.taskKey(msg.UUID), data, 0).Err()
+}
+
+func normalizedPriority(p Priority) Priority {
+	switch p {
+	case PriorityHigh, PriorityLow:
+		return p
+	default:
+		return PriorityNormal
+	}
+}
+
+// Enqueue implements Broker.
+func (b *RedisBroker) Enqueue(ctx context.Context, msg *TaskMessage) error {
+	msg.State = StateQueued
+	if err := b.save(ctx, msg); err != nil {
+		return err
+	}
+	return b.client.ZAdd(ctx, b.pendingKey(normalizedPriority(msg.Priority)), redis.Z{
+		Score:  float64(msg.ScheduledAt.Unix()),
+		Member: msg.UUID,
+	}).Err()
+}
+
+// Dequeue implements Broker. It checks the high-priority sorted set first,
+// then walks the same weighted round-robin order PriorityQueue uses, so
+// low-priority tasks still get a turn under sustained normal-priority load.
+// A due high-priority task is always served before any other.
+func (b *RedisBroker) Dequeue(ctx context.Context) (*TaskMessage, error) {
+	for {
+		turn := atomic.AddInt64(&b.turn, 1)
+		for i := -1; i < len(priorityOrder); i++ {
+			var p Priority
+			if i == -1 {
+				p = PriorityHigh
+			} else {
+				p = priorityOrder[(int(turn)+i)%len(priorityOrder)]
+				if p == PriorityHigh {
+					continue // already tried above
+				}
+			}
+
+			msg, err := b.popDue(ctx, p)
+			if err != nil {
+				return nil, err
+			}
+			if msg != nil {
+				return msg, nil
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(250 * time.Millisecond):
+		}
+	}
+}
+
+// popDue removes and returns the oldest due task in priority p's sorted
+// set, or nil if none is due yet.
+func (b *RedisBroker) popDue(ctx context.Context, p Priority) (*TaskMessage, error) {
+	now := float64(time.Now().Unix())
+	ids, err := b.client.ZRangeByScore(ctx, b.pendingKey(p), &redis.ZRangeBy{
+		Min:   "-inf",
+		Max:   fmt.Sprintf("%f", now),
+		Count: 1,
+	}).Result()
+	if err != nil {
+		return nil, err
+	}
+	if len(ids) == 0 {
+		return nil, nil
+	}
+
+	removed, err := b.client.ZRem(ctx, b.pendingKey(p), ids[0]).Result()
+	if err != nil {
+		return nil, err
+	}
+	if removed == 0 {
+		// another worker claimed it first
+		return nil, nil
+	}
+
+	msg, err := b.Get(ctx, ids[0])
+	if err != nil {
+		return nil, err
+	}
+	// A task can be paused (via SetState) while it's still sitting in the
+	// pending set, e.g. because the concurrency limiter hasn't let a worker
+	// claim it yet. Don't clobber that back to running, or the pause is
+	// silently lost the moment a worker dequeues it.
+	if msg.State != StatePaused {
+		msg.State = StateRunning
+	}
+	if err := b.save(ctx, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// Ack implements Broker.
+func (b *RedisBroker) Ack(ctx context.Context, uuid string) error {
+	return b.SetState(ctx, uuid, StateCompleted)
+}
+
+// Fail implements Broker. On a retryable failure it persists StateFailed
+// before Schedule re-adds the task to its pending set, so the failed state
+// is durably observable via Get for the length of the backoff instead of
+// being clobbered straight back to queued.
+func (b *RedisBroker) Fail(ctx context.Context, msg *TaskMessage, _ error) error {
+	msg.Retries++
+	if msg.Retries > msg.MaxRetries {
+		msg.State = StateDead
+		if err := b.save(ctx, msg); err != nil {
+			return err
+		}
+		data, err := json.Marshal(msg)
+		if err != nil {
+			return err
+		}
+		return b.client.RPush(ctx, b.deadKey(), data).Err()
+	}
+	msg.State = StateFailed
+	if err := b.save(ctx, msg); err != nil {
+		return err
+	}
+	return b.Schedule(ctx, msg, time.Now().Add(backoffWithJitter(msg.Retries)))
+}
+
+// Schedule implements Broker. It leaves msg.State as the caller set it
+// (Fail sets StateFailed before calling Schedule for a retry) rather than
+// forcing StateQueued; popDue transitions a task to StateRunning once it's
+// actually dequeued, same as any other pending task.
+func (b *RedisBroker) Schedule(ctx context.Context, msg *TaskMessage, at time.Time) error {
+	msg.ScheduledAt = at
+	if err := b.save(ctx, msg); err != nil {
+		return err
+	}
+	return b.client.ZAdd(ctx, b.pendingKey(normalizedPriority(msg.Priority)), redis.Z{
+		Score:  float64(at.Unix()),
+		Member: msg.UUID,
+	}).Err()
+}
+
+// Get implements Broker.
+func (b *RedisBroker) Get(ctx context.Context, uuid string) (*TaskMessage, error) {
+	data, err := b.client.Get(ctx, b.taskKey(uuid)).Bytes()
+	if err == redis.Nil {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	var msg TaskMessage
+	if err := json.Unmarshal(data, &msg); err != nil {
+		return nil, err
+	}
+	return &msg, nil
+}
+
+// SetState implements Broker.
+func (b *RedisBroker) SetState(ctx context.Context, uuid string, state TaskState) error {
+	msg, err := b.Get(ctx, uuid)
+	if err != nil {
+		return err
+	}
+	msg.State = state
+	return b.save(ctx, msg)
+}
+
+// Update implements Broker.
+func (b *RedisBroker) Update(ctx context.Context, msg *TaskMessage) error {
+	return b.save(ctx, msg)
+}
+
+// DeadLetter implements Broker.
+func (b *RedisBroker) DeadLetter(ctx context.Context) ([]*TaskMessage, error) {
+	raw, err := b.client.LRange(ctx, b.deadKey(), 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+	out := make([]*TaskMessage, 0, len(raw))
+	for _, r := range raw {
+		var msg TaskMessage
+		if err := json.Unmarshal([]byte(r), &msg); err != nil {
+			return nil, err
+		}
+		out = append(out, &msg)
+	}
+	return out, nil
+}
+
+// QueueDepths implements Broker.
+func (b *RedisBroker) QueueDepths(ctx context.Context) (map[Priority]int, error) {
+	depths := make(map[Priority]int, 3)
+	for _, p := range []Priority{PriorityHigh, PriorityNormal, PriorityLow} {
+		n, err := b.client.ZCard(ctx, b.pendingKey(p)).Result()
+		if err != nil {
+			return nil, err
+		}
+		depths[p] = int(n)
+	}
+	return depths, nil
+}
@@ -0,0 +1,197 @@
+// Package handlers handles the routes
+package handlers
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func newTestMessage(uuid string, priority Priority) *TaskMessage {
+	return &TaskMessage{
+		UUID:       uuid,
+		Type:       "demo",
+		Priority:   priority,
+		MaxRetries: 2,
+	}
+}
+
+func TestInMemoryBrokerEnqueueDequeue(t *testing.T) {
+	b := NewInMemoryBroker()
+	ctx := context.Background()
+
+	if err := b.Enqueue(ctx, newTestMessage("low", PriorityLow)); err != nil {
+		t.Fatalf("Enqueue(low): %v", err)
+	}
+	if err := b.Enqueue(ctx, newTestMessage("high", PriorityHigh)); err != nil {
+		t.Fatalf("Enqueue(high): %v", err)
+	}
+
+	msg, err := b.Dequeue(ctx)
+	if err != nil {
+		t.Fatalf("Dequeue: %v", err)
+	}
+	if msg.UUID != "high" {
+		t.Fatalf("Dequeue returned %q, want high priority task first", msg.UUID)
+	}
+	if msg.State != StateRunning {
+		t.Fatalf("Dequeue returned state %q, want %q", msg.State, StateRunning)
+	}
+}
+
+func TestInMemoryBrokerDequeueBlocksUntilCancelled(t *testing.T) {
+	b := NewInMemoryBroker()
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	if _, err := b.Dequeue(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("Dequeue on empty broker returned %v, want context.DeadlineExceeded", err)
+	}
+}
+
+func TestInMemoryBrokerGetReturnsCopy(t *testing.T) {
+	b := NewInMemoryBroker()
+	ctx := context.Background()
+	if err := b.Enqueue(ctx, newTestMessage("task", PriorityNormal)); err != nil {
+		t.Fatalf("Enqueue: %v", err)
+	}
+
+	got, err := b.Get(ctx, "task")
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	got.Progress = 99
+
+	again, err := b.Get(ctx, "task")
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if again.Progress != 0 {
+		t.Fatalf("mutating a Get result changed the stored record: Progress = %d, want 0", again.Progress)
+	}
+}
+
+func TestInMemoryBrokerUpdatePersists(t *testing.T) {
+	b := NewInMemoryBroker()
+	ctx := context.Background()
+	if err := b.Enqueue(ctx, newTestMessage("task", PriorityNormal)); err != nil {
+		t.Fatalf("Enqueue: %v", err)
+	}
+
+	msg, err := b.Dequeue(ctx)
+	if err != nil {
+		t.Fatalf("Dequeue: %v", err)
+	}
+	msg.Progress = 50
+	if err := b.Update(ctx, msg); err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+
+	got, err := b.Get(ctx, "task")
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if got.Progress != 50 {
+		t.Fatalf("Get after Update returned Progress = %d, want 50", got.Progress)
+	}
+}
+
+func TestInMemoryBrokerFailRetriesThenDeadLetters(t *testing.T) {
+	b := NewInMemoryBroker()
+	ctx := context.Background()
+	msg := newTestMessage("task", PriorityNormal)
+	msg.MaxRetries = 1
+	if err := b.Enqueue(ctx, msg); err != nil {
+		t.Fatalf("Enqueue: %v", err)
+	}
+
+	dequeued, err := b.Dequeue(ctx)
+	if err != nil {
+		t.Fatalf("Dequeue: %v", err)
+	}
+	if err := b.Fail(ctx, dequeued, errTest); err != nil {
+		t.Fatalf("Fail (1st attempt): %v", err)
+	}
+
+	got, err := b.Get(ctx, "task")
+	if err != nil {
+		t.Fatalf("Get after 1st Fail: %v", err)
+	}
+	if got.State != StateFailed {
+		t.Fatalf("state after 1st Fail = %q, want %q", got.State, StateFailed)
+	}
+	if got.Retries != 1 {
+		t.Fatalf("retries after 1st Fail = %d, want 1", got.Retries)
+	}
+
+	// The retry Fail just scheduled won't be due for a while (backoff), so
+	// drive the 2nd attempt off the record Fail itself produced rather than
+	// waiting on Dequeue.
+	if err := b.Fail(ctx, got, errTest); err != nil {
+		t.Fatalf("Fail (2nd attempt): %v", err)
+	}
+
+	got, err = b.Get(ctx, "task")
+	if err != nil {
+		t.Fatalf("Get after 2nd Fail: %v", err)
+	}
+	if got.State != StateDead {
+		t.Fatalf("state after exhausting retries = %q, want %q", got.State, StateDead)
+	}
+
+	dead, err := b.DeadLetter(ctx)
+	if err != nil {
+		t.Fatalf("DeadLetter: %v", err)
+	}
+	if len(dead) != 1 || dead[0].UUID != "task" {
+		t.Fatalf("DeadLetter returned %+v, want one entry for %q", dead, "task")
+	}
+}
+
+func TestInMemoryBrokerQueueDepths(t *testing.T) {
+	b := NewInMemoryBroker()
+	ctx := context.Background()
+	if err := b.Enqueue(ctx, newTestMessage("a", PriorityHigh)); err != nil {
+		t.Fatalf("Enqueue: %v", err)
+	}
+	if err := b.Enqueue(ctx, newTestMessage("b", PriorityLow)); err != nil {
+		t.Fatalf("Enqueue: %v", err)
+	}
+
+	depths, err := b.QueueDepths(ctx)
+	if err != nil {
+		t.Fatalf("QueueDepths: %v", err)
+	}
+	if depths[PriorityHigh] != 1 || depths[PriorityLow] != 1 || depths[PriorityNormal] != 0 {
+		t.Fatalf("QueueDepths = %+v, want high:1 low:1 normal:0", depths)
+	}
+}
+
+func TestInMemoryBrokerDequeuePreservesPause(t *testing.T) {
+	b := NewInMemoryBroker()
+	ctx := context.Background()
+	if err := b.Enqueue(ctx, newTestMessage("task", PriorityNormal)); err != nil {
+		t.Fatalf("Enqueue: %v", err)
+	}
+
+	// Pause the task while it's still sitting in the ready queue, before any
+	// worker has dequeued it - the window chunk0-3's concurrency limiter
+	// opens up.
+	if err := b.SetState(ctx, "task", StatePaused); err != nil {
+		t.Fatalf("SetState: %v", err)
+	}
+
+	msg, err := b.Dequeue(ctx)
+	if err != nil {
+		t.Fatalf("Dequeue: %v", err)
+	}
+	if msg.State != StatePaused {
+		t.Fatalf("Dequeue returned state %q, want %q to survive the dequeue", msg.State, StatePaused)
+	}
+}
+
+var errTest = &testError{"boom"}
+
+type testError struct{ msg string }
+
+func (e *testError) Error() string { return e.msg }
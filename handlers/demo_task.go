@@ -0,0 +1,74 @@
+// Package handlers handles the routes
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+)
+
+// demoStepDuration simulates the cost of a single unit of work.
+const demoStepDuration = 3 * time.Second
+
+// demoSteps is the number of steps demoTask runs through.
+const demoSteps = 10
+
+// demoTaskState is what demoTask checkpoints after every step, and what it
+// expects back as payload when resuming.
+type demoTaskState struct {
+	Step int `json:"step"`
+}
+
+// demoTask is the built-in Task registered under the "demo" type. It stands
+// in for a real task body, stepping through demoSteps pretend units of work
+// and reporting progress after each one; task-manager's other task types
+// are expected to be registered the same way.
+type demoTask struct {
+	fromStep int
+}
+
+// NewDemoTask is a TaskFactory for demoTask. payload is empty for a fresh
+// task, or the last demoTaskState a prior run checkpointed, in which case
+// the task resumes from fromStep instead of from the beginning.
+func NewDemoTask(payload json.RawMessage) (Task, error) {
+	var state demoTaskState
+	if len(payload) > 0 {
+		if err := json.Unmarshal(payload, &state); err != nil {
+			return nil, err
+		}
+	}
+	return demoTask{fromStep: state.Step}, nil
+}
+
+// Type implements Task.
+func (demoTask) Type() string { return "demo" }
+
+// Run implements Task.
+func (t demoTask) Run(ctx context.Context, p Progress) error {
+	for step := t.fromStep; step < demoSteps; step++ {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(demoStepDuration):
+		}
+
+		p.Report(step+1, demoSteps, "")
+
+		checkpoint, err := json.Marshal(demoTaskState{Step: step + 1})
+		if err != nil {
+			return err
+		}
+		if err := p.Checkpoint(checkpoint); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Rollback implements Task. demoTask has no side effects to undo.
+func (demoTask) Rollback(context.Context) error {
+	return nil
+}
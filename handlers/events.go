@@ -0,0 +1,178 @@
+// Package handlers handles the routes
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// TaskEventType identifies what happened to a task.
+type TaskEventType string
+
+// Event types published over the EventBus as a task moves through its
+// lifecycle.
+const (
+	EventCreated           TaskEventType = "created"
+	EventRunning           TaskEventType = "running"
+	EventPaused            TaskEventType = "paused"
+	EventResumed           TaskEventType = "resumed"
+	EventKilled            TaskEventType = "killed"
+	EventProgress          TaskEventType = "progress"
+	EventCompleted         TaskEventType = "completed"
+	EventFailed            TaskEventType = "failed"
+	EventRollbackStarted   TaskEventType = "rollback_started"
+	EventRollbackCompleted TaskEventType = "rollback_completed"
+	// EventOverflow is synthesized by EventBus in place of whatever event a
+	// slow subscriber missed, so the client knows its view has gaps.
+	EventOverflow TaskEventType = "overflow"
+)
+
+// TaskEvent is a single state transition or log line published to an
+// EventBus subscriber.
+type TaskEvent struct {
+	UUID      string        `json:"uuid,omitempty"`
+	Type      TaskEventType `json:"type"`
+	Message   string        `json:"message,omitempty"`
+	Progress  int           `json:"progress,omitempty"`
+	Timestamp time.Time     `json:"timestamp"`
+}
+
+// eventSubscriberBuffer is how many events a slow subscriber can fall behind
+// by before EventBus starts dropping the oldest ones in its buffer.
+const eventSubscriberBuffer = 32
+
+// eventSubscriber is one Subscribe call's delivery channel, optionally
+// filtered to a single task's events.
+type eventSubscriber struct {
+	uuid string // "" means subscribe to every task's events
+	ch   chan TaskEvent
+}
+
+// EventBus fans task lifecycle events out to any number of subscribers,
+// which is what lets GET /tasks/{id}/events and GET /events tail task
+// progress over SSE without polling. A slow consumer never blocks the
+// producer: once its buffer fills, EventBus drops the oldest buffered
+// event and replaces it with an EventOverflow marker.
+type EventBus struct {
+	mu          sync.Mutex
+	subscribers map[int]*eventSubscriber
+	nextID      int
+}
+
+// NewEventBus creates an empty EventBus.
+func NewEventBus() *EventBus {
+	return &EventBus{subscribers: make(map[int]*eventSubscriber)}
+}
+
+// Publish delivers evt to every subscriber whose filter matches evt.UUID.
+func (b *EventBus) Publish(evt TaskEvent) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, s := range b.subscribers {
+		if s.uuid != "" && s.uuid != evt.UUID {
+			continue
+		}
+		deliver(s.ch, evt)
+	}
+}
+
+// deliver sends evt on ch without blocking; if ch is full it drops the
+// oldest buffered event and substitutes an EventOverflow marker so the
+// subscriber knows it missed something.
+func deliver(ch chan TaskEvent, evt TaskEvent) {
+	select {
+	case ch <- evt:
+		return
+	default:
+	}
+
+	select {
+	case <-ch:
+	default:
+	}
+	overflow := TaskEvent{UUID: evt.UUID, Type: EventOverflow, Timestamp: evt.Timestamp}
+	select {
+	case ch <- overflow:
+	default:
+	}
+}
+
+// Subscribe registers a new subscriber, filtered to uuid's events if uuid is
+// non-empty, or every task's events otherwise. The returned cancel func must
+// be called once the subscriber is done to release its channel.
+func (b *EventBus) Subscribe(uuid string) (<-chan TaskEvent, func()) {
+	b.mu.Lock()
+	id := b.nextID
+	b.nextID++
+	s := &eventSubscriber{uuid: uuid, ch: make(chan TaskEvent, eventSubscriberBuffer)}
+	b.subscribers[id] = s
+	b.mu.Unlock()
+
+	cancel := func() {
+		b.mu.Lock()
+		delete(b.subscribers, id)
+		b.mu.Unlock()
+	}
+	return s.ch, cancel
+}
+
+// StreamTaskEvents streams a single task's lifecycle events as
+// Server-Sent Events until the client disconnects.
+func (t *TaskHandler) StreamTaskEvents(rw http.ResponseWriter, r *http.Request) {
+	uuid, ok := r.Context().Value(KeyUUID{}).(string)
+	if !ok {
+		return
+	}
+	t.streamEvents(rw, r, uuid)
+}
+
+// StreamEvents streams every task's lifecycle events as Server-Sent Events
+// until the client disconnects.
+func (t *TaskHandler) StreamEvents(rw http.ResponseWriter, r *http.Request) {
+	t.streamEvents(rw, r, "")
+}
+
+func (t *TaskHandler) streamEvents(rw http.ResponseWriter, r *http.Request, uuidFilter string) {
+	flusher, ok := rw.(http.Flusher)
+	if !ok {
+		t.responseWriter(rw, r, Response{Success: false, Err: "streaming unsupported"}, http.StatusInternalServerError)
+		return
+	}
+
+	ch, cancel := t.events.Subscribe(uuidFilter)
+	defer cancel()
+
+	rw.Header().Set("Content-Type", "text/event-stream")
+	rw.Header().Set("Cache-Control", "no-cache")
+	rw.Header().Set("Connection", "keep-alive")
+	rw.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case evt, ok := <-ch:
+			if !ok {
+				return
+			}
+			data, err := json.Marshal(evt)
+			if err != nil {
+				t.logger.WithFields(Fields{"task_uuid": evt.UUID, "error": err.Error()}).Error("failed to marshal task event")
+				continue
+			}
+			if _, err := rw.Write([]byte("data: ")); err != nil {
+				return
+			}
+			if _, err := rw.Write(data); err != nil {
+				return
+			}
+			if _, err := rw.Write([]byte("\n\n")); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
@@ -0,0 +1,65 @@
+// Package handlers handles the routes
+package handlers
+
+import (
+	"os"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Fields attaches structured key/value context to a single log line.
+type Fields map[string]interface{}
+
+// Logger is the structured logging interface used throughout task-manager,
+// so call sites never depend on logrus directly and a different backend
+// can be swapped in without touching them.
+type Logger interface {
+	// WithFields returns a Logger that attaches fields to every line it
+	// logs, in addition to this Logger's own fields.
+	WithFields(fields Fields) Logger
+	Debug(args ...interface{})
+	Info(args ...interface{})
+	Warn(args ...interface{})
+	Error(args ...interface{})
+	Fatal(args ...interface{})
+}
+
+// logrusLogger is a Logger backed by logrus.
+type logrusLogger struct {
+	entry *logrus.Entry
+}
+
+// NewLogger creates a Logger writing to stdout. level is debug/info/warn/error
+// or any other level name logrus accepts, such as fatal (case-insensitive;
+// unrecognized values fall back to info) and format is text or json
+// (unrecognized values fall back to text).
+func NewLogger(level, format string) Logger {
+	l := logrus.New()
+	l.SetOutput(os.Stdout)
+
+	if strings.EqualFold(format, "json") {
+		l.SetFormatter(&logrus.JSONFormatter{})
+	} else {
+		l.SetFormatter(&logrus.TextFormatter{FullTimestamp: true})
+	}
+
+	lvl, err := logrus.ParseLevel(level)
+	if err != nil {
+		lvl = logrus.InfoLevel
+	}
+	l.SetLevel(lvl)
+
+	return &logrusLogger{entry: logrus.NewEntry(l)}
+}
+
+// WithFields implements Logger.
+func (l *logrusLogger) WithFields(fields Fields) Logger {
+	return &logrusLogger{entry: l.entry.WithFields(logrus.Fields(fields))}
+}
+
+func (l *logrusLogger) Debug(args ...interface{}) { l.entry.Debug(args...) }
+func (l *logrusLogger) Info(args ...interface{})  { l.entry.Info(args...) }
+func (l *logrusLogger) Warn(args ...interface{})  { l.entry.Warn(args...) }
+func (l *logrusLogger) Error(args ...interface{}) { l.entry.Error(args...) }
+func (l *logrusLogger) Fatal(args ...interface{}) { l.entry.Fatal(args...) }
@@ -0,0 +1,144 @@
+// Package handlers handles the routes
+package handlers
+
+import (
+	"errors"
+	"sync"
+)
+
+// Priority is the admission priority of a task. Higher-priority ring
+// buffers are drained before lower-priority ones; once no high-priority
+// task is waiting, a weighted round-robin between normal and low keeps
+// low-priority tasks from being starved by normal-priority ones.
+type Priority string
+
+// Priorities accepted on POST /tasks and /create.
+const (
+	PriorityHigh   Priority = "high"
+	PriorityNormal Priority = "normal"
+	PriorityLow    Priority = "low"
+)
+
+// ErrQueueFull is returned when a priority ring buffer is at capacity.
+var ErrQueueFull = errors.New("handlers: priority queue is full")
+
+// ringCapacity bounds each priority's ring buffer so a burst of CreateTask
+// calls can't grow memory unbounded while tasks wait for a worker slot.
+const ringCapacity = 1024
+
+// ringBuffer is a fixed-capacity FIFO queue of TaskMessage pointers.
+type ringBuffer struct {
+	buf   []*TaskMessage
+	head  int
+	count int
+}
+
+func newRingBuffer(capacity int) *ringBuffer {
+	return &ringBuffer{buf: make([]*TaskMessage, capacity)}
+}
+
+func (r *ringBuffer) push(msg *TaskMessage) bool {
+	if r.count == len(r.buf) {
+		return false
+	}
+	tail := (r.head + r.count) % len(r.buf)
+	r.buf[tail] = msg
+	r.count++
+	return true
+}
+
+func (r *ringBuffer) pop() (*TaskMessage, bool) {
+	if r.count == 0 {
+		return nil, false
+	}
+	msg := r.buf[r.head]
+	r.buf[r.head] = nil
+	r.head = (r.head + 1) % len(r.buf)
+	r.count--
+	return msg, true
+}
+
+func (r *ringBuffer) len() int {
+	return r.count
+}
+
+// priorityOrder is the weighted round-robin sequence PriorityQueue.Pop
+// falls back to once no high-priority task is waiting: normal and high
+// alternate, with low mixed in every fifth turn, so low-priority tasks
+// still make progress under sustained load instead of starving outright.
+var priorityOrder = []Priority{
+	PriorityHigh, PriorityNormal, PriorityHigh, PriorityNormal, PriorityLow,
+}
+
+// PriorityQueue fans CreateTask admissions out into per-priority ring
+// buffers, guarded by a single mutex, and hands them back in priority
+// order to whatever is feeding the worker pool.
+type PriorityQueue struct {
+	mu     sync.Mutex
+	queues map[Priority]*ringBuffer
+	turn   int
+}
+
+// NewPriorityQueue creates an empty PriorityQueue with one ring buffer per
+// priority level.
+func NewPriorityQueue() *PriorityQueue {
+	return &PriorityQueue{
+		queues: map[Priority]*ringBuffer{
+			PriorityHigh:   newRingBuffer(ringCapacity),
+			PriorityNormal: newRingBuffer(ringCapacity),
+			PriorityLow:    newRingBuffer(ringCapacity),
+		},
+	}
+}
+
+// Push enqueues msg onto its priority's ring buffer, defaulting to normal
+// priority for an unrecognized value. It returns ErrQueueFull once that
+// ring buffer is at capacity.
+func (q *PriorityQueue) Push(msg *TaskMessage) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	rb, ok := q.queues[msg.Priority]
+	if !ok {
+		rb = q.queues[PriorityNormal]
+	}
+	if !rb.push(msg) {
+		return ErrQueueFull
+	}
+	return nil
+}
+
+// Pop removes and returns the next task to admit. High priority is always
+// served first; once it's empty, Pop walks priorityOrder starting from
+// where it left off so normal and low priority tasks interleave instead of
+// low priority being starved for as long as normal-priority work keeps
+// arriving. ok is false if every ring buffer is empty.
+func (q *PriorityQueue) Pop() (*TaskMessage, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if rb := q.queues[PriorityHigh]; rb.len() > 0 {
+		q.turn++
+		return rb.pop()
+	}
+
+	for i := 0; i < len(priorityOrder); i++ {
+		p := priorityOrder[(q.turn+i)%len(priorityOrder)]
+		if rb := q.queues[p]; rb.len() > 0 {
+			q.turn++
+			return rb.pop()
+		}
+	}
+	return nil, false
+}
+
+// Depths returns the current length of each priority's ring buffer, for
+// GET /queue.
+func (q *PriorityQueue) Depths() map[Priority]int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return map[Priority]int{
+		PriorityHigh:   q.queues[PriorityHigh].len(),
+		PriorityNormal: q.queues[PriorityNormal].len(),
+		PriorityLow:    q.queues[PriorityLow].len(),
+	}
+}
@@ -0,0 +1,217 @@
+// Package handlers handles the routes
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
+
+// Service lifecycle states used by BaseService.
+const (
+	serviceStopped int32 = iota
+	serviceRunning
+	serviceStopping
+)
+
+// Service is a component with an explicit start/stop lifecycle, modeled on
+// tendermint's service abstraction. It replaces the previous int-over-channel
+// pause/resume/kill protocol with context cancellation and guards against
+// double-start/double-stop.
+type Service interface {
+	Start(ctx context.Context) error
+	Stop() error
+	Wait()
+	IsRunning() bool
+}
+
+// BaseService implements the bookkeeping shared by every Service in this
+// package: start/stop state transitions guarded by sync/atomic, and a
+// WaitGroup other goroutines can block on via Wait.
+type BaseService struct {
+	name  string
+	state int32
+	quit  chan struct{}
+	wg    sync.WaitGroup
+}
+
+// NewBaseService creates a BaseService identified by name, used in error
+// messages when a caller double-starts or double-stops it.
+func NewBaseService(name string) *BaseService {
+	return &BaseService{name: name, quit: make(chan struct{})}
+}
+
+// Start transitions the service from stopped to running. It returns an
+// error rather than panicking if the service was already started, so
+// callers can decide how to handle a double-start.
+func (b *BaseService) Start(context.Context) error {
+	if !atomic.CompareAndSwapInt32(&b.state, serviceStopped, serviceRunning) {
+		return fmt.Errorf("handlers: %s already started", b.name)
+	}
+	b.wg.Add(1)
+	return nil
+}
+
+// Stop transitions the service to stopping and closes the channel returned
+// by Quit, so the service's run loop can observe the cancellation. It
+// returns an error if the service isn't running.
+func (b *BaseService) Stop() error {
+	if !atomic.CompareAndSwapInt32(&b.state, serviceRunning, serviceStopping) {
+		return fmt.Errorf("handlers: %s not running", b.name)
+	}
+	close(b.quit)
+	return nil
+}
+
+// Done marks the service's run loop as finished, unblocking Wait and
+// allowing the service to be started again.
+func (b *BaseService) Done() {
+	atomic.StoreInt32(&b.state, serviceStopped)
+	b.wg.Done()
+}
+
+// Wait blocks until Done has been called.
+func (b *BaseService) Wait() {
+	b.wg.Wait()
+}
+
+// IsRunning reports whether the service is currently running.
+func (b *BaseService) IsRunning() bool {
+	return atomic.LoadInt32(&b.state) == serviceRunning
+}
+
+// Quit returns a channel that is closed once Stop has been called.
+func (b *BaseService) Quit() <-chan struct{} {
+	return b.quit
+}
+
+// TaskService runs a single task to completion, built on BaseService so it
+// shares the same start/stop bookkeeping as any other Service. Kill is
+// implemented by cancelling a per-task context derived from the root
+// context passed to NewTaskService; pause/resume gate the task's own run
+// loop with a sync.Cond instead of blocking on channel reads.
+type TaskService struct {
+	*BaseService
+	uuid   string
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// killed is set by Stop, so callers can tell a real kill apart from the
+	// context cancellation Start's goroutine always performs on its way out.
+	killed int32
+
+	pauseMu   sync.Mutex
+	pauseCond *sync.Cond
+	paused    bool
+
+	run func(ctx context.Context) error
+}
+
+// NewTaskService creates a TaskService for uuid whose context is derived
+// from parent, so killing parent (e.g. during shutdown) kills every
+// in-flight TaskService along with it.
+func NewTaskService(uuid string, parent context.Context, run func(ctx context.Context) error) *TaskService {
+	ctx, cancel := context.WithCancel(parent)
+	ts := &TaskService{
+		BaseService: NewBaseService("TaskService:" + uuid),
+		uuid:        uuid,
+		ctx:         ctx,
+		cancel:      cancel,
+		run:         run,
+	}
+	ts.pauseCond = sync.NewCond(&ts.pauseMu)
+	return ts
+}
+
+// Start launches the task's run function in its own goroutine.
+func (ts *TaskService) Start(ctx context.Context) error {
+	if err := ts.BaseService.Start(ctx); err != nil {
+		return err
+	}
+	go func() {
+		defer ts.Done()
+		defer ts.cancel()
+		_ = ts.run(ts.ctx)
+	}()
+	return nil
+}
+
+// Stop kills the task by cancelling its context; it does not wait for the
+// run function to observe the cancellation, use Wait for that.
+func (ts *TaskService) Stop() error {
+	atomic.StoreInt32(&ts.killed, 1)
+	ts.cancel()
+	// TaskService's own Stop is driven by context cancellation rather than
+	// BaseService's quit channel, so there's no BaseService.Stop to call
+	// here; IsRunning/Wait still work via the embedded BaseService.
+	return nil
+}
+
+// Pause blocks WaitWhilePaused callers (the task's own run loop, via its
+// Progress) until Resume is called.
+func (ts *TaskService) Pause() {
+	ts.pauseMu.Lock()
+	ts.paused = true
+	ts.pauseMu.Unlock()
+}
+
+// Resume releases a task blocked in WaitWhilePaused.
+func (ts *TaskService) Resume() {
+	ts.pauseMu.Lock()
+	ts.paused = false
+	ts.pauseMu.Unlock()
+	ts.pauseCond.Broadcast()
+}
+
+// WaitWhilePaused blocks the calling goroutine while the service is paused.
+// The task's run function should call this between units of work.
+func (ts *TaskService) WaitWhilePaused() {
+	ts.pauseMu.Lock()
+	for ts.paused {
+		ts.pauseCond.Wait()
+	}
+	ts.pauseMu.Unlock()
+}
+
+// Context returns the task's context, cancelled when the task is killed or
+// the root context passed to NewTaskService is cancelled.
+func (ts *TaskService) Context() context.Context {
+	return ts.ctx
+}
+
+// Killed reports whether Stop has been called on ts. Start's goroutine
+// always cancels ts's context on its way out, win or lose, so Context().Err()
+// is non-nil on every terminal path and can't distinguish a real kill from a
+// normal completion or failure - callers that need that distinction must use
+// Killed instead.
+func (ts *TaskService) Killed() bool {
+	return atomic.LoadInt32(&ts.killed) == 1
+}
+
+// serviceRegistry tracks the in-flight TaskService for each running task, so
+// HTTP handlers can reach a task's Pause/Resume/Kill without the races that
+// came from sharing plain maps across handler and worker goroutines.
+type serviceRegistry struct {
+	services sync.Map // uuid -> *TaskService
+}
+
+func newServiceRegistry() *serviceRegistry {
+	return &serviceRegistry{}
+}
+
+func (r *serviceRegistry) put(uuid string, ts *TaskService) {
+	r.services.Store(uuid, ts)
+}
+
+func (r *serviceRegistry) delete(uuid string) {
+	r.services.Delete(uuid)
+}
+
+func (r *serviceRegistry) get(uuid string) *TaskService {
+	v, ok := r.services.Load(uuid)
+	if !ok {
+		return nil
+	}
+	return v.(*TaskService)
+}
@@ -0,0 +1,89 @@
+// Package handlers handles the routes
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+)
+
+// Task is a pluggable unit of work the worker pool executes. Concrete task
+// types register a TaskFactory with a Registry under the name Type()
+// returns, matching the "type" field of CreateTaskRequest.
+type Task interface {
+	// Type identifies the task type this instance was built from.
+	Type() string
+	// Run executes the task to completion, reporting progress and
+	// checkpoints through p as it goes. Run must return promptly once ctx
+	// is cancelled.
+	Run(ctx context.Context, p Progress) error
+	// Rollback undoes any partial effect of a Run that failed or was
+	// killed. It is called with a fresh context bounded by
+	// rollbackDuration, so it should not depend on ctx living very long.
+	Rollback(ctx context.Context) error
+}
+
+// Progress lets a Task report step-level progress and persist resumable
+// state back to the broker while it runs.
+type Progress interface {
+	// Report records that step of total has completed, with an optional
+	// human-readable message. The worker gates Report on the task's pause
+	// state, so a Task implements pause support for free by calling it
+	// between units of work.
+	Report(step, total int, msg string)
+	// Checkpoint persists state so that if the task is restarted, its
+	// factory can resume from here instead of from scratch.
+	Checkpoint(state json.RawMessage) error
+}
+
+// ErrUnknownTaskType is returned by Registry.New when no factory is
+// registered for the given type.
+var ErrUnknownTaskType = errors.New("handlers: unknown task type")
+
+// TaskFactory builds a Task from a task's payload, which is either the
+// payload a CreateTaskRequest was submitted with or, when resuming a task
+// that checkpointed, the last checkpoint it saved.
+type TaskFactory func(payload json.RawMessage) (Task, error)
+
+// Registry maps task type names to the factories that build them, so
+// CreateTask can turn a request's "type" field into a runnable Task without
+// the handlers package knowing about any concrete task implementation.
+type Registry struct {
+	mu        sync.RWMutex
+	factories map[string]TaskFactory
+}
+
+// NewRegistry creates an empty Registry.
+func NewRegistry() *Registry {
+	return &Registry{factories: make(map[string]TaskFactory)}
+}
+
+// Register adds factory under typ, overwriting any previous registration
+// for that type. Intended to be called at startup, before the worker pool
+// begins dequeuing tasks.
+func (r *Registry) Register(typ string, factory TaskFactory) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.factories[typ] = factory
+}
+
+// Has reports whether a factory is registered for typ.
+func (r *Registry) Has(typ string) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	_, ok := r.factories[typ]
+	return ok
+}
+
+// New builds a Task of typ from payload, or returns ErrUnknownTaskType if
+// nothing is registered for it.
+func (r *Registry) New(typ string, payload json.RawMessage) (Task, error) {
+	r.mu.RLock()
+	factory, ok := r.factories[typ]
+	r.mu.RUnlock()
+	if !ok {
+		return nil, ErrUnknownTaskType
+	}
+	return factory(payload)
+}
@@ -4,9 +4,7 @@ package handlers
 import (
 	"context"
 	"encoding/json"
-	"log"
 	"net/http"
-	"runtime"
 	"strings"
 	"sync"
 	"time"
@@ -16,17 +14,15 @@ import (
 )
 
 const (
-	// Constants denoting the state of a task
-	start = 2
-	pause = 1
-	kill  = 0
-
-	// taskDuration indicates the duration of the task to be simulated
-	taskDuration = 3
-	// taskCount indicates the number of tasks
-	taskCount = 10
-	// rollbackDuration
+	// defaultMaxRetries is used when a task request does not specify one.
+	defaultMaxRetries = 3
+	// defaultTimeoutSeconds is used when a task request does not specify one.
+	defaultTimeoutSeconds = 30
+	// rollbackDuration bounds, in seconds, the context a task's Rollback runs with
 	rollbackDuration = 1
+	// shutdownDrainTimeout bounds how long TerminateTasks waits for
+	// in-flight TaskServices to observe cancellation before giving up.
+	shutdownDrainTimeout = 5 * time.Second
 )
 
 // Response represents the API response
@@ -37,120 +33,361 @@ type Response struct {
 	Success bool   `json:"success"`
 }
 
-// responseWriter sends the response to client in the form of json
-func responseWriter(w http.ResponseWriter, payload interface{}, code int) {
+// responseWriter sends the response to client in the form of json. It is a
+// TaskHandler method rather than a free function so an encode failure logs
+// through the structured Logger, tagged with the request's correlation ID,
+// instead of the stdlib log package.
+func (t *TaskHandler) responseWriter(w http.ResponseWriter, r *http.Request, payload interface{}, code int) {
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
 	w.Header().Set("X-Content-Type-Options", "nosniff")
 	w.WriteHeader(code)
 	if err := json.NewEncoder(w).Encode(payload); err != nil {
-		log.Println("error: ", err)
+		t.requestLogger(r).WithFields(Fields{"error": err.Error()}).Error("failed to encode response")
 	}
 }
 
-var counter int
+// CreateTaskRequest is the JSON body accepted by POST /tasks.
+type CreateTaskRequest struct {
+	Type           string          `json:"type"`
+	Payload        json.RawMessage `json:"payload"`
+	Priority       Priority        `json:"priority,omitempty"`
+	RunAt          *time.Time      `json:"run_at,omitempty"`
+	DelaySeconds   int             `json:"delay_seconds,omitempty"`
+	MaxRetries     int             `json:"max_retries,omitempty"`
+	TimeoutSeconds int             `json:"timeout_seconds,omitempty"`
+}
+
+// TaskStatusResponse is returned by GET /tasks/{id}.
+type TaskStatusResponse struct {
+	UUID      string    `json:"uuid"`
+	State     TaskState `json:"state"`
+	QueuedAt  time.Time `json:"queued_at,omitempty"`
+	StartedAt time.Time `json:"started_at,omitempty"`
+	Progress  int       `json:"progress"`
+}
+
+// QueueStatusResponse is returned by GET /queue.
+type QueueStatusResponse struct {
+	Depths        map[Priority]int `json:"depths"`
+	ActiveWorkers int              `json:"active_workers"`
+	MaxConcurrent int              `json:"max_concurrent"`
+}
 
 // TaskHandler handles task handling requests
 type TaskHandler struct {
-	logger  *log.Logger
-	wg      *sync.WaitGroup
-	workers map[string](chan int)
-	states  map[string]int
+	logger        Logger
+	wg            *sync.WaitGroup
+	broker        Broker
+	pool          *WorkerPool
+	registry      *serviceRegistry
+	events        *EventBus
+	taskTypes     *Registry
+	maxConcurrent int
+	rootCtx       context.Context
+	cancel        context.CancelFunc
 }
 
-// NewTaskHandler creates a new instance of TaskHandler
-func NewTaskHandler(l *log.Logger, wg *sync.WaitGroup) *TaskHandler {
-	workers := make(map[string](chan int))
-	states := make(map[string]int)
-	return &TaskHandler{l, wg, workers, states}
+// NewTaskHandler creates a new instance of TaskHandler backed by broker,
+// with a worker pool of poolSize goroutines pulling tasks off of it, at
+// most maxConcurrent of which run at the same time; the broker serves
+// higher-priority tasks first (see PriorityQueue), and taskTypes resolves
+// each task's "type" field to the Task implementation that runs it. Every
+// task the pool runs is a TaskService derived from a root context owned by
+// TaskHandler, so TerminateTasks can kill every in-flight task by cancelling
+// that one context instead of fanning a kill signal out over channels.
+func NewTaskHandler(l Logger, wg *sync.WaitGroup, broker Broker, taskTypes *Registry, poolSize, maxConcurrent int) *TaskHandler {
+	ctx, cancel := context.WithCancel(context.Background())
+	registry := newServiceRegistry()
+	events := NewEventBus()
+	pool := NewWorkerPool(broker, l, wg, poolSize, maxConcurrent, ctx, registry, events, taskTypes)
+	pool.Start()
+	return &TaskHandler{
+		logger:        l,
+		wg:            wg,
+		broker:        broker,
+		pool:          pool,
+		registry:      registry,
+		events:        events,
+		taskTypes:     taskTypes,
+		maxConcurrent: maxConcurrent,
+		rootCtx:       ctx,
+		cancel:        cancel,
+	}
+}
+
+// requestLogger returns a Logger that tags every line it logs with the
+// correlation ID MiddlewareRequestID attached to r, so log aggregation can
+// group every line a single HTTP request produced.
+func (t *TaskHandler) requestLogger(r *http.Request) Logger {
+	reqID, _ := r.Context().Value(KeyRequestID{}).(string)
+	return t.logger.WithFields(Fields{"request_id": reqID})
 }
 
-// CreateTask spawns a new task
-func (t *TaskHandler) CreateTask(w http.ResponseWriter, _ *http.Request) {
-	t.logger.Println("Endpoint: create")
+// CreateTask writes a task into the broker and returns its UUID immediately;
+// the task itself runs later on whichever worker pulls it off the broker.
+func (t *TaskHandler) CreateTask(w http.ResponseWriter, r *http.Request) {
+	log := t.requestLogger(r)
+	log.Info("endpoint: create")
+
+	var req CreateTaskRequest
+	if r.Body != nil {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err.Error() != "EOF" {
+			resp := Response{Success: false, Err: "invalid request body: " + err.Error()}
+			t.responseWriter(w, r, resp, http.StatusBadRequest)
+			return
+		}
+	}
+
+	runAt := time.Now()
+	if req.RunAt != nil {
+		runAt = *req.RunAt
+	} else if req.DelaySeconds > 0 {
+		runAt = runAt.Add(time.Duration(req.DelaySeconds) * time.Second)
+	}
+
+	maxRetries := req.MaxRetries
+	if maxRetries == 0 {
+		maxRetries = defaultMaxRetries
+	}
+	timeoutSeconds := req.TimeoutSeconds
+	if timeoutSeconds == 0 {
+		timeoutSeconds = defaultTimeoutSeconds
+	}
+
+	priority := req.Priority
+	if priority == "" {
+		priority = PriorityNormal
+	}
+
+	taskType := req.Type
+	if taskType == "" {
+		taskType = "demo"
+	}
+	if !t.taskTypes.Has(taskType) {
+		resp := Response{Success: false, Err: "unknown task type: " + taskType}
+		t.responseWriter(w, r, resp, http.StatusBadRequest)
+		return
+	}
+
 	rawUUID := uuid.New()
-	uuid := strings.ReplaceAll(rawUUID.String(), "-", "")
-	t.workers[uuid] = make(chan int, 1)
-	t.states[uuid] = start
-	go task(counter, uuid, taskCount, t)
-	t.workers[uuid] <- start
-	t.logger.Println("Task created. uuid:", uuid)
-	counter++
-	resp := Response{Success: true, UUID: uuid}
-	responseWriter(w, resp, http.StatusOK)
+	id := strings.ReplaceAll(rawUUID.String(), "-", "")
+
+	msg := &TaskMessage{
+		UUID:           id,
+		Type:           taskType,
+		Payload:        req.Payload,
+		Priority:       priority,
+		MaxRetries:     maxRetries,
+		TimeoutSeconds: timeoutSeconds,
+		ScheduledAt:    runAt,
+		QueuedAt:       time.Now(),
+	}
+
+	if err := t.broker.Enqueue(r.Context(), msg); err != nil {
+		resp := Response{Success: false, Err: "could not enqueue task: " + err.Error()}
+		t.responseWriter(w, r, resp, http.StatusInternalServerError)
+		return
+	}
+
+	log.WithFields(Fields{"task_uuid": id, "task_type": taskType, "state": StateQueued}).Info("task created")
+	t.events.Publish(TaskEvent{UUID: id, Type: EventCreated, Timestamp: time.Now()})
+	resp := Response{Success: true, UUID: id}
+	t.responseWriter(w, r, resp, http.StatusOK)
 }
 
 // PauseTask pauses a task
 func (t *TaskHandler) PauseTask(rw http.ResponseWriter, r *http.Request) {
-	if uuid, ok := r.Context().Value(KeyUUID{}).(string); ok {
-		if t.states[uuid] == pause {
-			resp := Response{Success: true, Message: "Already paused"}
-			responseWriter(rw, resp, http.StatusOK)
-			return
-		}
-		t.logger.Println("Endpoint: pause")
-		t.workers[uuid] <- pause
-		t.states[uuid] = pause
-		resp := Response{Success: true}
-		responseWriter(rw, resp, http.StatusOK)
+	uuid, ok := r.Context().Value(KeyUUID{}).(string)
+	if !ok {
+		return
 	}
+
+	msg, err := t.broker.Get(r.Context(), uuid)
+	if err != nil {
+		t.responseWriter(rw, r, Response{Success: false, Err: err.Error()}, http.StatusNotFound)
+		return
+	}
+	if msg.State == StatePaused {
+		resp := Response{Success: true, Message: "Already paused"}
+		t.responseWriter(rw, r, resp, http.StatusOK)
+		return
+	}
+
+	log := t.requestLogger(r).WithFields(Fields{"task_uuid": uuid, "task_type": msg.Type})
+	log.WithFields(Fields{"state": StatePaused}).Info("endpoint: pause")
+	if err := t.broker.SetState(r.Context(), uuid, StatePaused); err != nil {
+		t.responseWriter(rw, r, Response{Success: false, Err: err.Error()}, http.StatusInternalServerError)
+		return
+	}
+	if ts := t.registry.get(uuid); ts != nil {
+		ts.Pause()
+	}
+	t.events.Publish(TaskEvent{UUID: uuid, Type: EventPaused, Timestamp: time.Now()})
+	resp := Response{Success: true}
+	t.responseWriter(rw, r, resp, http.StatusOK)
 }
 
 // ResumeTask resumes a paused task
 func (t *TaskHandler) ResumeTask(rw http.ResponseWriter, r *http.Request) {
-	if uuid, ok := r.Context().Value(KeyUUID{}).(string); ok {
-		if t.states[uuid] == start {
-			resp := Response{Success: true, Message: "Already runnning"}
-			responseWriter(rw, resp, http.StatusOK)
-			return
-		}
+	uuid, ok := r.Context().Value(KeyUUID{}).(string)
+	if !ok {
+		return
+	}
 
-		t.logger.Println("Endpoint: resume")
-		t.workers[uuid] <- start
-		t.states[uuid] = start
-		resp := Response{Success: true}
-		responseWriter(rw, resp, http.StatusOK)
+	msg, err := t.broker.Get(r.Context(), uuid)
+	if err != nil {
+		t.responseWriter(rw, r, Response{Success: false, Err: err.Error()}, http.StatusNotFound)
+		return
 	}
+	if msg.State == StateRunning {
+		resp := Response{Success: true, Message: "Already runnning"}
+		t.responseWriter(rw, r, resp, http.StatusOK)
+		return
+	}
+
+	log := t.requestLogger(r).WithFields(Fields{"task_uuid": uuid, "task_type": msg.Type})
+	log.WithFields(Fields{"state": StateRunning}).Info("endpoint: resume")
+	if err := t.broker.SetState(r.Context(), uuid, StateRunning); err != nil {
+		t.responseWriter(rw, r, Response{Success: false, Err: err.Error()}, http.StatusInternalServerError)
+		return
+	}
+	if ts := t.registry.get(uuid); ts != nil {
+		ts.Resume()
+	}
+	t.events.Publish(TaskEvent{UUID: uuid, Type: EventResumed, Timestamp: time.Now()})
+	resp := Response{Success: true}
+	t.responseWriter(rw, r, resp, http.StatusOK)
 }
 
 // DeleteTask terminates an ongoing task
 func (t *TaskHandler) DeleteTask(rw http.ResponseWriter, r *http.Request) {
-	if uuid, ok := r.Context().Value(KeyUUID{}).(string); ok {
-		t.logger.Println("Endpoint: delete")
-		t.workers[uuid] <- kill
-		t.states[uuid] = kill
-		resp := Response{Success: true}
-		responseWriter(rw, resp, http.StatusOK)
+	uuid, ok := r.Context().Value(KeyUUID{}).(string)
+	if !ok {
+		return
+	}
+
+	taskType := ""
+	if msg, err := t.broker.Get(r.Context(), uuid); err == nil {
+		taskType = msg.Type
+	}
+	log := t.requestLogger(r).WithFields(Fields{"task_uuid": uuid, "task_type": taskType})
+	log.WithFields(Fields{"state": StateKilled}).Info("endpoint: delete")
+	if err := t.broker.SetState(r.Context(), uuid, StateKilled); err != nil {
+		t.responseWriter(rw, r, Response{Success: false, Err: err.Error()}, http.StatusInternalServerError)
+		return
+	}
+	if ts := t.registry.get(uuid); ts != nil {
+		ts.Stop()
 	}
+	t.events.Publish(TaskEvent{UUID: uuid, Type: EventKilled, Timestamp: time.Now()})
+	resp := Response{Success: true}
+	t.responseWriter(rw, r, resp, http.StatusOK)
 }
 
-func (t *TaskHandler) closeRoutine(uuid string) {
-	t.wg.Done()
-	close(t.workers[uuid])
-	delete(t.workers, uuid)
-	delete(t.states, uuid)
+// GetTaskStatus returns a task's current state, timestamps, and progress.
+func (t *TaskHandler) GetTaskStatus(rw http.ResponseWriter, r *http.Request) {
+	uuid, ok := r.Context().Value(KeyUUID{}).(string)
+	if !ok {
+		return
+	}
+
+	msg, err := t.broker.Get(r.Context(), uuid)
+	if err != nil {
+		t.responseWriter(rw, r, Response{Success: false, Err: err.Error()}, http.StatusNotFound)
+		return
+	}
+
+	resp := TaskStatusResponse{
+		UUID:      msg.UUID,
+		State:     msg.State,
+		QueuedAt:  msg.QueuedAt,
+		StartedAt: msg.StartedAt,
+		Progress:  msg.Progress,
+	}
+	t.responseWriter(rw, r, resp, http.StatusOK)
 }
 
-// TerminateTasks sends a kill signal to all the running tasks
+// GetQueueStatus returns the depth of each priority queue and how many
+// workers are currently executing a task.
+func (t *TaskHandler) GetQueueStatus(rw http.ResponseWriter, r *http.Request) {
+	depths, err := t.broker.QueueDepths(r.Context())
+	if err != nil {
+		t.responseWriter(rw, r, Response{Success: false, Err: err.Error()}, http.StatusInternalServerError)
+		return
+	}
+
+	resp := QueueStatusResponse{
+		Depths:        depths,
+		ActiveWorkers: t.pool.Active(),
+		MaxConcurrent: t.maxConcurrent,
+	}
+	t.responseWriter(rw, r, resp, http.StatusOK)
+}
+
+// TerminateTasks cancels the root context every task and worker derives
+// from, killing them all in one step, then waits up to
+// shutdownDrainTimeout for each in-flight TaskService to actually observe
+// the cancellation before giving up.
 func (t *TaskHandler) TerminateTasks() {
-	for k := range t.workers {
-		t.workers[k] <- kill
+	ctx := context.Background()
+	dead, err := t.broker.DeadLetter(ctx)
+	if err != nil {
+		t.logger.WithFields(Fields{"error": err.Error()}).Error("failed to list dead-letter tasks")
+	}
+	for _, msg := range dead {
+		t.logger.WithFields(Fields{"task_uuid": msg.UUID, "task_type": msg.Type, "state": StateDead}).Warn("dead-letter task left unprocessed")
+	}
+
+	t.cancel()
+
+	deadline := time.After(shutdownDrainTimeout)
+	done := make(chan struct{})
+	go func() {
+		t.registry.services.Range(func(_, v interface{}) bool {
+			v.(*TaskService).Wait()
+			return true
+		})
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-deadline:
+		t.logger.Warn("shutdown: timed out waiting for tasks to drain")
 	}
 }
 
 // KeyUUID represents data saved in the context
 type KeyUUID struct{}
 
+// KeyRequestID is the context key the per-request correlation ID generated
+// by MiddlewareRequestID is stored under, alongside KeyUUID.
+type KeyRequestID struct{}
+
+// MiddlewareRequestID generates a correlation ID for every request, stores
+// it in the context so handlers can attach it to their log lines via
+// requestLogger, and echoes it back as X-Request-ID so a client can
+// correlate its request with the server's logs. It has no TaskHandler
+// dependencies, unlike MiddlewareCheckTask, so it is a plain function
+// instead of a method.
+func MiddlewareRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		reqID := strings.ReplaceAll(uuid.New().String(), "-", "")
+		rw.Header().Set("X-Request-ID", reqID)
+		ctx := context.WithValue(r.Context(), KeyRequestID{}, reqID)
+		next.ServeHTTP(rw, r.WithContext(ctx))
+	})
+}
+
 // MiddlewareCheckTask validates the uuid passed with the endpoint and saves it in the context
 func (t *TaskHandler) MiddlewareCheckTask(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
 		vars := mux.Vars(r)
 		i := vars["id"]
 
-		_, ok := t.workers[i]
-
-		if !ok {
-			err := Response{Success: false, Err: "task for given uuid does not exist"}
-			responseWriter(rw, err, http.StatusBadRequest)
+		if _, err := t.broker.Get(r.Context(), i); err != nil {
+			resp := Response{Success: false, Err: "task for given uuid does not exist"}
+			t.responseWriter(rw, r, resp, http.StatusBadRequest)
 			return
 		}
 
@@ -160,48 +397,3 @@ func (t *TaskHandler) MiddlewareCheckTask(next http.Handler) http.Handler {
 		next.ServeHTTP(rw, r)
 	})
 }
-
-// task implements pause, resume and delete functionality
-func task(id int, uuid string, count int, t *TaskHandler) {
-	t.wg.Add(1)
-	defer t.closeRoutine(uuid)
-
-	// simulates long running task
-	for i := 0; i < count; i++ {
-		if len(t.workers[uuid]) > 0 {
-			state := <-t.workers[uuid]
-			if state == pause {
-				t.logger.Println("uuid:", uuid, "status: paused")
-				for state == pause {
-					state = <-t.workers[uuid]
-				}
-			}
-
-			if state == kill {
-				t.logger.Println("uuid:", uuid, "status: killed")
-				t.logger.Println("rollback initiated")
-				go rollBack(uuid, t)
-				return
-			}
-
-			t.logger.Println("uuid:", uuid, "status: running")
-		}
-		// ensures concurrency by forcing scheduler to rechedule on another task
-		runtime.Gosched()
-
-		// Dummy task, can be replaced with actual task to be performed
-		t.logger.Println("id:", id, "value:", i)
-		time.Sleep(taskDuration * time.Second)
-	}
-
-	t.logger.Println("uuid:", uuid, "status: completed")
-}
-
-func rollBack(uuid string, t *TaskHandler) {
-	t.wg.Add(1)
-	defer t.wg.Done()
-
-	// Dummy task, can be replaced with actual rollback task to be performed
-	time.Sleep(rollbackDuration * time.Second)
-	t.logger.Println("uuid:", uuid, "status: Rollback completed")
-}
@@ -0,0 +1,223 @@
+// Package handlers handles the routes
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+// WorkerPool pulls TaskMessage records off a Broker and runs each one as a
+// TaskService, instead of spawning one goroutine per incoming request. This
+// bounds the number of concurrently running tasks to the pool size and lets
+// tasks survive process restarts, since durable state lives in the Broker
+// rather than in local goroutine stacks. A semaphore additionally caps how
+// many tasks may be executing at once (maxConcurrent), independent of how
+// many worker goroutines are polling the broker.
+type WorkerPool struct {
+	broker    Broker
+	logger    Logger
+	wg        *sync.WaitGroup
+	size      int
+	rootCtx   context.Context
+	registry  *serviceRegistry
+	events    *EventBus
+	taskTypes *Registry
+	sem       chan struct{}
+}
+
+// NewWorkerPool creates a WorkerPool of size workers that will read tasks
+// from broker, running at most maxConcurrent of them at any one time, built
+// into a Task via taskTypes. Every task it runs is derived from rootCtx, so
+// cancelling rootCtx kills every in-flight task. Call Start to launch the
+// workers.
+func NewWorkerPool(broker Broker, logger Logger, wg *sync.WaitGroup, size int, maxConcurrent int, rootCtx context.Context, registry *serviceRegistry, events *EventBus, taskTypes *Registry) *WorkerPool {
+	return &WorkerPool{
+		broker:    broker,
+		logger:    logger,
+		wg:        wg,
+		size:      size,
+		rootCtx:   rootCtx,
+		registry:  registry,
+		events:    events,
+		taskTypes: taskTypes,
+		sem:       make(chan struct{}, maxConcurrent),
+	}
+}
+
+// Start launches the pool's worker goroutines.
+func (p *WorkerPool) Start() {
+	for i := 0; i < p.size; i++ {
+		p.wg.Add(1)
+		go p.runWorker(i)
+	}
+}
+
+// Active returns how many tasks are currently holding a concurrency-limiter
+// slot, i.e. actually executing rather than merely queued.
+func (p *WorkerPool) Active() int {
+	return len(p.sem)
+}
+
+func (p *WorkerPool) runWorker(id int) {
+	defer p.wg.Done()
+	for {
+		msg, err := p.broker.Dequeue(p.rootCtx)
+		if err != nil {
+			// rootCtx cancelled, pool is shutting down
+			return
+		}
+		p.runTask(id, msg)
+	}
+}
+
+// runTask acquires a concurrency-limiter slot, builds the Task msg.Type
+// names (resuming from msg.Checkpoint if one was saved), registers its
+// TaskService so PauseTask/ResumeTask/DeleteTask can reach it, and runs it
+// to completion, failure, or kill.
+func (p *WorkerPool) runTask(workerID int, msg *TaskMessage) {
+	select {
+	case p.sem <- struct{}{}:
+	case <-p.rootCtx.Done():
+		return
+	}
+	defer func() { <-p.sem }()
+
+	log := p.logger.WithFields(Fields{"task_uuid": msg.UUID, "task_type": msg.Type})
+
+	payload := msg.Payload
+	if len(msg.Checkpoint) > 0 {
+		payload = msg.Checkpoint
+	}
+	tsk, err := p.taskTypes.New(msg.Type, payload)
+	if err != nil {
+		log.WithFields(Fields{"error": err.Error()}).Error("failed to build task")
+		if err := p.broker.Fail(p.rootCtx, msg, err); err != nil {
+			log.WithFields(Fields{"error": err.Error()}).Error("failed to record task failure")
+		}
+		p.events.Publish(TaskEvent{UUID: msg.UUID, Type: EventFailed, Message: err.Error(), Timestamp: time.Now()})
+		return
+	}
+
+	msg.StartedAt = time.Now()
+	if err := p.broker.Update(p.rootCtx, msg); err != nil {
+		log.WithFields(Fields{"error": err.Error()}).Warn("failed to persist task start")
+	}
+	log.WithFields(Fields{"state": StateRunning}).Info("task started")
+	p.events.Publish(TaskEvent{UUID: msg.UUID, Type: EventRunning, Timestamp: msg.StartedAt})
+
+	var svcErr error
+	progress := &taskProgress{pool: p, msg: msg}
+	ts := NewTaskService(msg.UUID, p.rootCtx, func(ctx context.Context) error {
+		svcErr = tsk.Run(ctx, progress)
+		return svcErr
+	})
+
+	p.registry.put(msg.UUID, ts)
+	defer p.registry.delete(msg.UUID)
+
+	// msg.State is StatePaused when the task was paused while still queued,
+	// i.e. before any TaskService existed for PauseTask's registry lookup to
+	// find. Apply that pause to the TaskService we just registered so it
+	// takes effect before Run starts instead of being silently dropped.
+	if msg.State == StatePaused {
+		ts.Pause()
+	}
+
+	if err := ts.Start(p.rootCtx); err != nil {
+		log.WithFields(Fields{"error": err.Error()}).Error("failed to start task service")
+		return
+	}
+	ts.Wait()
+
+	duration := time.Since(msg.StartedAt)
+	switch {
+	case ts.Killed():
+		log.WithFields(Fields{"state": StateKilled, "duration_ms": duration.Milliseconds()}).Info("task killed")
+		go p.rollBack(tsk, msg.UUID, msg.Type)
+	case svcErr != nil:
+		log.WithFields(Fields{
+			"state":       StateFailed,
+			"retries":     msg.Retries,
+			"duration_ms": duration.Milliseconds(),
+			"error":       svcErr.Error(),
+		}).Warn("task failed")
+		if err := p.broker.Fail(p.rootCtx, msg, svcErr); err != nil {
+			log.WithFields(Fields{"error": err.Error()}).Error("failed to record task failure")
+		}
+		p.events.Publish(TaskEvent{UUID: msg.UUID, Type: EventFailed, Message: svcErr.Error(), Timestamp: time.Now()})
+		go p.rollBack(tsk, msg.UUID, msg.Type)
+	default:
+		log.WithFields(Fields{"state": StateCompleted, "duration_ms": duration.Milliseconds()}).Info("task completed")
+		if err := p.broker.Ack(p.rootCtx, msg.UUID); err != nil {
+			log.WithFields(Fields{"error": err.Error()}).Error("failed to ack task")
+		}
+		p.events.Publish(TaskEvent{UUID: msg.UUID, Type: EventCompleted, Timestamp: time.Now()})
+	}
+}
+
+// rollBack invokes tsk's Rollback with a fresh context bounded by
+// rollbackDuration, since a task that failed or was killed partway through
+// may have left side effects behind that Run itself never gets to undo.
+func (p *WorkerPool) rollBack(tsk Task, uuid, taskType string) {
+	p.wg.Add(1)
+	defer p.wg.Done()
+
+	log := p.logger.WithFields(Fields{"task_uuid": uuid, "task_type": taskType})
+	start := time.Now()
+
+	log.WithFields(Fields{"state": "rollback_started"}).Info("rollback started")
+	p.events.Publish(TaskEvent{UUID: uuid, Type: EventRollbackStarted, Timestamp: start})
+
+	ctx, cancel := context.WithTimeout(context.Background(), rollbackDuration*time.Second)
+	defer cancel()
+
+	duration := func() int64 { return time.Since(start).Milliseconds() }
+	if err := tsk.Rollback(ctx); err != nil {
+		log.WithFields(Fields{"state": "rollback_failed", "duration_ms": duration(), "error": err.Error()}).Error("rollback failed")
+	} else {
+		log.WithFields(Fields{"state": "rollback_completed", "duration_ms": duration()}).Info("rollback completed")
+	}
+	p.events.Publish(TaskEvent{UUID: uuid, Type: EventRollbackCompleted, Timestamp: time.Now()})
+}
+
+// taskProgress is the Progress a WorkerPool hands to a Task's Run. Report
+// gates on the task's pause state, looked up from the pool's service
+// registry, so pause/resume work without the Task implementation knowing
+// anything about TaskService; Checkpoint persists resumable state through
+// the broker so a re-run of the same task can pick up where this one left
+// off.
+type taskProgress struct {
+	pool *WorkerPool
+	msg  *TaskMessage
+}
+
+// Report implements Progress.
+func (p *taskProgress) Report(step, total int, msg string) {
+	if ts := p.pool.registry.get(p.msg.UUID); ts != nil {
+		ts.WaitWhilePaused()
+	}
+
+	progress := 0
+	if total > 0 {
+		progress = step * 100 / total
+	}
+	p.msg.Progress = progress
+	if err := p.pool.broker.Update(p.pool.rootCtx, p.msg); err != nil {
+		p.pool.logger.WithFields(Fields{
+			"task_uuid": p.msg.UUID,
+			"task_type": p.msg.Type,
+			"step":      step,
+			"total":     total,
+			"error":     err.Error(),
+		}).Warn("failed to persist task progress")
+	}
+	p.pool.events.Publish(TaskEvent{UUID: p.msg.UUID, Type: EventProgress, Progress: progress, Message: msg, Timestamp: time.Now()})
+}
+
+// Checkpoint implements Progress.
+func (p *taskProgress) Checkpoint(state json.RawMessage) error {
+	p.msg.Checkpoint = state
+	return p.pool.broker.Update(p.pool.rootCtx, p.msg)
+}
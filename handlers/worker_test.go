@@ -0,0 +1,236 @@
+// Package handlers handles the routes
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeTask is a Task whose Run/Rollback behavior is supplied by the test
+// that builds it, so WorkerPool's lifecycle can be driven deterministically
+// without waiting on demoTask's real timers.
+type fakeTask struct {
+	runFn      func(ctx context.Context, p Progress) error
+	rollbackCh chan struct{}
+}
+
+func (f *fakeTask) Type() string { return "fake" }
+
+func (f *fakeTask) Run(ctx context.Context, p Progress) error {
+	return f.runFn(ctx, p)
+}
+
+func (f *fakeTask) Rollback(context.Context) error {
+	if f.rollbackCh != nil {
+		close(f.rollbackCh)
+	}
+	return nil
+}
+
+// newTestPool builds a WorkerPool around task, registered under "fake", with
+// its own broker/registry/event bus so tests don't interfere with each
+// other. Logging is set to fatal to keep test output quiet.
+func newTestPool(task *fakeTask) (*WorkerPool, Broker, *serviceRegistry) {
+	taskTypes := NewRegistry()
+	taskTypes.Register("fake", func(json.RawMessage) (Task, error) { return task, nil })
+
+	broker := NewInMemoryBroker()
+	registry := newServiceRegistry()
+	events := NewEventBus()
+	logger := NewLogger("fatal", "text")
+	var wg sync.WaitGroup
+
+	pool := NewWorkerPool(broker, logger, &wg, 1, 1, context.Background(), registry, events, taskTypes)
+	return pool, broker, registry
+}
+
+// waitForRegistered polls the registry until uuid's TaskService is visible or
+// the timeout elapses, since runTask registers it from a separate goroutine
+// in the kill/pause tests below.
+func waitForRegistered(t *testing.T, registry *serviceRegistry, uuid string) *TaskService {
+	t.Helper()
+	deadline := time.After(time.Second)
+	for {
+		if ts := registry.get(uuid); ts != nil {
+			return ts
+		}
+		select {
+		case <-deadline:
+			t.Fatalf("TaskService for %q never registered", uuid)
+		case <-time.After(time.Millisecond):
+		}
+	}
+}
+
+func TestWorkerPoolRunTaskCompletes(t *testing.T) {
+	task := &fakeTask{runFn: func(context.Context, Progress) error { return nil }}
+	pool, broker, _ := newTestPool(task)
+
+	ctx := context.Background()
+	msg := newTestMessage("ok", PriorityNormal)
+	msg.Type = "fake"
+	if err := broker.Enqueue(ctx, msg); err != nil {
+		t.Fatalf("Enqueue: %v", err)
+	}
+	dequeued, err := broker.Dequeue(ctx)
+	if err != nil {
+		t.Fatalf("Dequeue: %v", err)
+	}
+
+	pool.runTask(0, dequeued)
+
+	got, err := broker.Get(ctx, "ok")
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if got.State != StateCompleted {
+		t.Fatalf("state after successful run = %q, want %q", got.State, StateCompleted)
+	}
+}
+
+func TestWorkerPoolRunTaskFailsAndRollsBack(t *testing.T) {
+	rollbackCh := make(chan struct{})
+	task := &fakeTask{
+		runFn:      func(context.Context, Progress) error { return errTest },
+		rollbackCh: rollbackCh,
+	}
+	pool, broker, _ := newTestPool(task)
+
+	ctx := context.Background()
+	msg := newTestMessage("fails", PriorityNormal)
+	msg.Type = "fake"
+	msg.MaxRetries = 5
+	if err := broker.Enqueue(ctx, msg); err != nil {
+		t.Fatalf("Enqueue: %v", err)
+	}
+	dequeued, err := broker.Dequeue(ctx)
+	if err != nil {
+		t.Fatalf("Dequeue: %v", err)
+	}
+
+	pool.runTask(0, dequeued)
+
+	got, err := broker.Get(ctx, "fails")
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if got.State != StateFailed {
+		t.Fatalf("state after failed run = %q, want %q", got.State, StateFailed)
+	}
+
+	select {
+	case <-rollbackCh:
+	case <-time.After(time.Second):
+		t.Fatal("Rollback was not called after a failed run")
+	}
+}
+
+func TestWorkerPoolRunTaskKilled(t *testing.T) {
+	rollbackCh := make(chan struct{})
+	task := &fakeTask{
+		runFn: func(ctx context.Context, _ Progress) error {
+			<-ctx.Done()
+			return ctx.Err()
+		},
+		rollbackCh: rollbackCh,
+	}
+	pool, broker, registry := newTestPool(task)
+
+	ctx := context.Background()
+	msg := newTestMessage("killed", PriorityNormal)
+	msg.Type = "fake"
+	if err := broker.Enqueue(ctx, msg); err != nil {
+		t.Fatalf("Enqueue: %v", err)
+	}
+	dequeued, err := broker.Dequeue(ctx)
+	if err != nil {
+		t.Fatalf("Dequeue: %v", err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		pool.runTask(0, dequeued)
+		close(done)
+	}()
+
+	ts := waitForRegistered(t, registry, "killed")
+	if err := ts.Stop(); err != nil {
+		t.Fatalf("Stop: %v", err)
+	}
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("runTask did not return after the TaskService was killed")
+	}
+
+	select {
+	case <-rollbackCh:
+	case <-time.After(time.Second):
+		t.Fatal("Rollback was not called after a killed run")
+	}
+}
+
+func TestWorkerPoolRunTaskStartsPausedWhenDequeuedPaused(t *testing.T) {
+	reported := make(chan struct{})
+	done := make(chan struct{})
+	task := &fakeTask{
+		runFn: func(_ context.Context, p Progress) error {
+			p.Report(1, 2, "")
+			close(reported)
+			return nil
+		},
+	}
+	pool, broker, registry := newTestPool(task)
+
+	ctx := context.Background()
+	msg := newTestMessage("paused", PriorityNormal)
+	msg.Type = "fake"
+	if err := broker.Enqueue(ctx, msg); err != nil {
+		t.Fatalf("Enqueue: %v", err)
+	}
+	// Pause before the task is dequeued, exactly the window chunk0-3's
+	// concurrency limiter opens up: the task is paused while still queued,
+	// before any TaskService exists for PauseTask's registry lookup to find.
+	if err := broker.SetState(ctx, "paused", StatePaused); err != nil {
+		t.Fatalf("SetState: %v", err)
+	}
+
+	dequeued, err := broker.Dequeue(ctx)
+	if err != nil {
+		t.Fatalf("Dequeue: %v", err)
+	}
+	if dequeued.State != StatePaused {
+		t.Fatalf("Dequeue returned state %q, want %q", dequeued.State, StatePaused)
+	}
+
+	go func() {
+		pool.runTask(0, dequeued)
+		close(done)
+	}()
+
+	ts := waitForRegistered(t, registry, "paused")
+
+	select {
+	case <-reported:
+		t.Fatal("Report returned before the task was resumed, pause was not applied")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	ts.Resume()
+
+	select {
+	case <-reported:
+	case <-time.After(time.Second):
+		t.Fatal("Report did not unblock after Resume")
+	}
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("runTask did not return after resume")
+	}
+}
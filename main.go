@@ -3,7 +3,6 @@ package main
 
 import (
 	"context"
-	"log"
 	"net/http"
 	"os"
 	"os/signal"
@@ -12,24 +11,40 @@ import (
 	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/redis/go-redis/v9"
+
 	"github.com/lintopaul/task-manager/handlers"
 )
 
 const (
 	// timeout for context
 	timeout = 30
+	// poolSize is the number of worker goroutines pulling tasks off the broker
+	poolSize = 5
+	// maxConcurrent bounds how many tasks may run at the same time, regardless
+	// of poolSize
+	maxConcurrent = 5
 )
 
 func main() {
-	logger := log.New(os.Stdout, "task-manager-api ", log.LstdFlags)
+	logger := handlers.NewLogger(os.Getenv("LOG_LEVEL"), os.Getenv("LOG_FORMAT"))
 
 	var wg sync.WaitGroup
 
 	router := mux.NewRouter()
+	router.Use(handlers.MiddlewareRequestID)
+
+	broker := newBroker(logger)
 
-	taskHandler := handlers.NewTaskHandler(logger, &wg)
+	taskTypes := handlers.NewRegistry()
+	taskTypes.Register("demo", handlers.NewDemoTask)
+
+	taskHandler := handlers.NewTaskHandler(logger, &wg, broker, taskTypes, poolSize, maxConcurrent)
 
 	router.HandleFunc("/create", taskHandler.CreateTask).Methods("GET")
+	router.HandleFunc("/tasks", taskHandler.CreateTask).Methods("POST")
+	router.HandleFunc("/queue", taskHandler.GetQueueStatus).Methods("GET")
+	router.HandleFunc("/events", taskHandler.StreamEvents).Methods("GET")
 
 	api := router.PathPrefix("/").Subrouter()
 	api.Use(taskHandler.MiddlewareCheckTask)
@@ -37,6 +52,8 @@ func main() {
 	api.HandleFunc("/pause/{id}", taskHandler.PauseTask).Methods("GET")
 	api.HandleFunc("/delete/{id}", taskHandler.DeleteTask).Methods("GET")
 	api.HandleFunc("/resume/{id}", taskHandler.ResumeTask).Methods("GET")
+	api.HandleFunc("/tasks/{id}", taskHandler.GetTaskStatus).Methods("GET")
+	api.HandleFunc("/tasks/{id}/events", taskHandler.StreamTaskEvents).Methods("GET")
 
 	s := &http.Server{
 		Addr:    ":9090",
@@ -44,7 +61,7 @@ func main() {
 	}
 
 	go func() {
-		logger.Println("Starting server on port 9090")
+		logger.Info("starting server on port 9090")
 		logger.Fatal(s.ListenAndServe())
 	}()
 
@@ -61,13 +78,28 @@ func main() {
 	// Used such that the go program waits for all the goroutines to finish before it closes
 	wg.Wait()
 
-	logger.Println("Received terminate, properly terminated all tasks")
-	logger.Println("Reason:", sig)
+	logger.WithFields(handlers.Fields{"reason": sig.String()}).Info("received terminate, properly terminated all tasks")
 
 	tc, cancel := context.WithTimeout(context.Background(), timeout*time.Second)
 	defer cancel()
 
 	if err := s.Shutdown(tc); err != nil {
-		logger.Println("error: ", err)
+		logger.WithFields(handlers.Fields{"error": err.Error()}).Error("error shutting down server")
 	}
 }
+
+// newBroker returns a RedisBroker when REDIS_ADDR is set, falling back to an
+// InMemoryBroker otherwise. Running without Redis is fine for local
+// development, but tasks won't survive a restart or be shared across
+// instances.
+func newBroker(logger handlers.Logger) handlers.Broker {
+	addr := os.Getenv("REDIS_ADDR")
+	if addr == "" {
+		logger.Info("REDIS_ADDR not set, using in-memory broker")
+		return handlers.NewInMemoryBroker()
+	}
+
+	client := redis.NewClient(&redis.Options{Addr: addr})
+	logger.WithFields(handlers.Fields{"redis_addr": addr}).Info("using redis broker")
+	return handlers.NewRedisBroker(client, "task-manager")
+}